@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	defaultBatchSize   = 32
+	defaultWorkerCount = 1
+)
+
+// batchSizeFromEnv and workerCountFromEnv read LATTICE_BATCH_SIZE and
+// LATTICE_WORKERS, falling back to sane defaults for anything missing or
+// invalid.
+func batchSizeFromEnv() int   { return positiveEnvInt("LATTICE_BATCH_SIZE", defaultBatchSize) }
+func workerCountFromEnv() int { return positiveEnvInt("LATTICE_WORKERS", defaultWorkerCount) }
+
+func positiveEnvInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+// batchPacketConn is the subset of golang.org/x/net/ipv4.PacketConn (its
+// Message type is shared with ipv6.PacketConn) that lets the echo loop
+// drain and send many datagrams per syscall via recvmmsg/sendmmsg.
+type batchPacketConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// newBatchConn wraps conn for batched I/O. recvmmsg/sendmmsg are Linux-only,
+// so on any other GOOS it reports ok=false and callers fall back to
+// runSingle's plain ReadFromUDP/WriteToUDP.
+func newBatchConn(conn *net.UDPConn) (batchPacketConn, bool) {
+	if runtime.GOOS != "linux" {
+		return nil, false
+	}
+	return ipv4.NewPacketConn(conn), true
+}
+
+// makeBatch allocates n message buffers of frameLen bytes, ready to be
+// reused across repeated ReadBatch/WriteBatch calls.
+func makeBatch(n, frameLen int) []ipv4.Message {
+	msgs := make([]ipv4.Message, n)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, frameLen)}
+	}
+	return msgs
+}
+
+// runBatch drives the echo loop using ReadBatch/WriteBatch, draining up to
+// batchSize datagrams per recvmmsg syscall and echoing the accepted ones
+// back in a single sendmmsg. Safe to run concurrently from multiple
+// goroutines over the same batchPacketConn.
+func (s *server) runBatch(bc batchPacketConn, batchSize int) {
+	rms := makeBatch(batchSize, s.maxLen)
+	wms := make([]ipv4.Message, batchSize)
+
+	for {
+		readStart := time.Now()
+		n, err := bc.ReadBatch(rms, 0)
+		s.metrics.readLatency.Observe(time.Since(readStart).Seconds())
+		if err != nil || n == 0 {
+			continue
+		}
+
+		nEcho := 0
+		for i := 0; i < n; i++ {
+			m := rms[i]
+			frame := m.Buffers[0][:m.N]
+			addr, ok := m.Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			resp := s.process(frame, addr.IP)
+			if resp == nil {
+				continue
+			}
+			wms[nEcho].Buffers = [][]byte{resp}
+			wms[nEcho].Addr = addr
+			nEcho++
+		}
+		if nEcho == 0 {
+			continue
+		}
+		writeStart := time.Now()
+		for sent := 0; sent < nEcho; {
+			k, err := bc.WriteBatch(wms[sent:nEcho], 0)
+			if err != nil || k == 0 {
+				break
+			}
+			sent += k
+		}
+		s.metrics.writeLatency.Observe(time.Since(writeStart).Seconds())
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+// newLoopbackPair opens two unconnected UDP sockets on loopback, so the
+// benchmarks can send real datagrams from one to the other with real
+// WriteBatch/WriteToUDP syscalls rather than just the in-process processing
+// logic.
+func newLoopbackPair(tb testing.TB) (a, b *net.UDPConn) {
+	tb.Helper()
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatalf("listen a: %v", err)
+	}
+	b, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		a.Close()
+		tb.Fatalf("listen b: %v", err)
+	}
+	return a, b
+}
+
+// BenchmarkRunBatch_WriteBatch measures sendmmsg throughput for a batch of
+// datagrams sent in one syscall, the thing chunk0-3 exists to speed up.
+// Only meaningful on Linux, where recvmmsg/sendmmsg actually exist;
+// newBatchConn's ok=false fallback on other platforms means this benchmark
+// would be measuring nothing there.
+func BenchmarkRunBatch_WriteBatch(b *testing.B) {
+	if runtime.GOOS != "linux" {
+		b.Skip("recvmmsg/sendmmsg are Linux-only")
+	}
+
+	aConn, bConn := newLoopbackPair(b)
+	defer aConn.Close()
+	defer bConn.Close()
+
+	bc, ok := newBatchConn(aConn)
+	if !ok {
+		b.Fatal("newBatchConn: ok=false on linux")
+	}
+
+	batchSize := defaultBatchSize
+	msgs := makeBatch(batchSize, payloadLen)
+	for i := range msgs {
+		msgs[i].Addr = bConn.LocalAddr()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bc.WriteBatch(msgs, 0); err != nil {
+			b.Fatalf("WriteBatch: %v", err)
+		}
+	}
+}
+
+// BenchmarkRunSingle_WriteToUDP is the non-batched baseline: the same
+// number of datagrams sent one syscall at a time, for comparison against
+// BenchmarkRunBatch_WriteBatch.
+func BenchmarkRunSingle_WriteToUDP(b *testing.B) {
+	aConn, bConn := newLoopbackPair(b)
+	defer aConn.Close()
+	defer bConn.Close()
+
+	payload := make([]byte, payloadLen)
+	dst := bConn.LocalAddr().(*net.UDPAddr)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < defaultBatchSize; j++ {
+			if _, err := aConn.WriteToUDP(payload, dst); err != nil {
+				b.Fatalf("WriteToUDP: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+var testSecret = []byte("test-secret-at-least-16-bytes!!")
+
+// buildHMACFrame assembles a valid data frame for the HMAC cipher the way a
+// client would, so Open has something real to verify.
+func buildHMACFrame(c *hmacCipher, sid, seq uint64) []byte {
+	frame := make([]byte, c.FrameLen())
+	copy(frame[:magicLen], dataMagic)
+	binary.BigEndian.PutUint64(frame[magicLen:seqOffset], sid)
+	binary.BigEndian.PutUint64(frame[seqOffset:headerLen], seq)
+	tagAt := len(frame) - hmacTagLen
+	binary.BigEndian.PutUint32(frame[tagAt:], c.tag(frame[:tagAt]))
+	return frame
+}
+
+// buildAEADFrame assembles a valid data frame for an AEAD cipher the way a
+// client would: seal the payload under AD = magic+sessionID, nonce derived
+// from seq, same as aeadCipher.Open expects.
+func buildAEADFrame(c *aeadCipher, sid, seq uint64) []byte {
+	frame := make([]byte, headerLen)
+	copy(frame[:magicLen], dataMagic)
+	binary.BigEndian.PutUint64(frame[magicLen:seqOffset], sid)
+	binary.BigEndian.PutUint64(frame[seqOffset:headerLen], seq)
+	ad := frame[:seqOffset]
+	plaintext := make([]byte, payloadLen)
+	sealed := c.aead.Seal(nil, c.nonce(seq), plaintext, ad)
+	return append(frame, sealed...)
+}
+
+func TestCipher_HMAC_RoundTrip(t *testing.T) {
+	c, err := NewCipher("hmac", testSecret)
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	hc := c.(*hmacCipher)
+
+	frame := buildHMACFrame(hc, 42, 7)
+	seq, ok := c.Open(frame)
+	if !ok {
+		t.Fatal("Open: want true for an untampered frame")
+	}
+	if seq != 7 {
+		t.Fatalf("Open: got seq %d, want 7", seq)
+	}
+}
+
+func TestCipher_HMAC_RejectsTamperedTag(t *testing.T) {
+	c, err := NewCipher("hmac", testSecret)
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	frame := buildHMACFrame(c.(*hmacCipher), 42, 7)
+	frame[len(frame)-1] ^= 0xFF
+	if _, ok := c.Open(frame); ok {
+		t.Fatal("Open: want false for a tampered tag")
+	}
+}
+
+func TestCipher_HMAC_RejectsTamperedPayload(t *testing.T) {
+	c, err := NewCipher("hmac", testSecret)
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	frame := buildHMACFrame(c.(*hmacCipher), 42, 7)
+	frame[headerLen] ^= 0xFF // flip a payload bit covered by the tag
+	if _, ok := c.Open(frame); ok {
+		t.Fatal("Open: want false once the authenticated payload changes")
+	}
+}
+
+func TestCipher_AEAD_RoundTrip(t *testing.T) {
+	for _, kind := range []string{"chacha20poly1305", "aes-gcm"} {
+		t.Run(kind, func(t *testing.T) {
+			c, err := NewCipher(kind, testSecret)
+			if err != nil {
+				t.Fatalf("NewCipher(%q): %v", kind, err)
+			}
+			ac := c.(*aeadCipher)
+
+			frame := buildAEADFrame(ac, 42, 7)
+			seq, ok := c.Open(frame)
+			if !ok {
+				t.Fatal("Open: want true for an untampered frame")
+			}
+			if seq != 7 {
+				t.Fatalf("Open: got seq %d, want 7", seq)
+			}
+		})
+	}
+}
+
+func TestCipher_AEAD_RejectsTamperedCiphertext(t *testing.T) {
+	for _, kind := range []string{"chacha20poly1305", "aes-gcm"} {
+		t.Run(kind, func(t *testing.T) {
+			c, err := NewCipher(kind, testSecret)
+			if err != nil {
+				t.Fatalf("NewCipher(%q): %v", kind, err)
+			}
+			frame := buildAEADFrame(c.(*aeadCipher), 42, 7)
+			frame[len(frame)-1] ^= 0xFF
+			if _, ok := c.Open(frame); ok {
+				t.Fatal("Open: want false for tampered ciphertext")
+			}
+		})
+	}
+}
+
+func TestCipher_AEAD_RejectsTamperedAD(t *testing.T) {
+	for _, kind := range []string{"chacha20poly1305", "aes-gcm"} {
+		t.Run(kind, func(t *testing.T) {
+			c, err := NewCipher(kind, testSecret)
+			if err != nil {
+				t.Fatalf("NewCipher(%q): %v", kind, err)
+			}
+			frame := buildAEADFrame(c.(*aeadCipher), 42, 7)
+			// Session ID is part of the AD; changing it after sealing must
+			// invalidate the tag even though the ciphertext is untouched.
+			binary.BigEndian.PutUint64(frame[magicLen:seqOffset], 43)
+			if _, ok := c.Open(frame); ok {
+				t.Fatal("Open: want false once the AD (session ID) changes")
+			}
+		})
+	}
+}
+
+func TestNewCipher_UnknownKind(t *testing.T) {
+	if _, err := NewCipher("rot13", testSecret); err == nil {
+		t.Fatal("NewCipher: want an error for an unknown cipher kind")
+	}
+}
+
+func TestCipher_FrameLenMatchesWhatOpenExpects(t *testing.T) {
+	for _, kind := range []string{"hmac", "chacha20poly1305", "aes-gcm"} {
+		c, err := NewCipher(kind, testSecret)
+		if err != nil {
+			t.Fatalf("NewCipher(%q): %v", kind, err)
+		}
+		var frame []byte
+		switch kind {
+		case "hmac":
+			frame = buildHMACFrame(c.(*hmacCipher), 1, 1)
+		default:
+			frame = buildAEADFrame(c.(*aeadCipher), 1, 1)
+		}
+		if len(frame) != c.FrameLen() {
+			t.Fatalf("%s: FrameLen()=%d, built frame is %d bytes", kind, c.FrameLen(), len(frame))
+		}
+	}
+}
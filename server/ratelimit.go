@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// The old single map[string]*bucket only worked because the server ran one
+// packet-handling goroutine; multiple LATTICE_WORKERS now hammer the same
+// map concurrently. Sharding by source address (the same idea as
+// sync.Map's internal striping, or Go's own runtime scheduler run queues)
+// keeps lock contention down to whichever shards two busy workers happen to
+// collide on, instead of a single mutex for the whole table. netip.Addr
+// keys also avoid the per-packet allocation that addr.String() cost.
+const shardCount = 256
+
+type limitShard struct {
+	mu sync.Mutex
+	m  map[netip.Addr]*bucket
+}
+
+type rateLimiter struct {
+	shards [shardCount]*limitShard
+}
+
+func newRateLimiter() *rateLimiter {
+	rl := &rateLimiter{}
+	for i := range rl.shards {
+		rl.shards[i] = &limitShard{m: make(map[netip.Addr]*bucket)}
+	}
+	return rl
+}
+
+// fnv32a offset basis and prime, from hash/fnv, inlined so picking a shard
+// doesn't allocate a hash.Hash32 on every packet.
+const (
+	fnv32aOffset = 2166136261
+	fnv32aPrime  = 16777619
+)
+
+func (rl *rateLimiter) shardFor(addr netip.Addr) *limitShard {
+	b := addr.As16()
+	h := uint32(fnv32aOffset)
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= fnv32aPrime
+	}
+	return rl.shards[h&(shardCount-1)]
+}
+
+// allow applies the per-source-address token bucket.
+func (rl *rateLimiter) allow(addr netip.Addr) bool {
+	sh := rl.shardFor(addr)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	b, ok := sh.m[addr]
+	if !ok {
+		b = &bucket{tokens: maxTokens, last: now, lastSeen: now}
+		sh.m[addr] = b
+	}
+	elapsed := now.Sub(b.last).Seconds()
+	if added := int(elapsed * refillPerS); added > 0 {
+		b.tokens += added
+		if b.tokens > maxTokens {
+			b.tokens = maxTokens
+			b.last = now
+		} else {
+			// Keep the unrefilled fraction of a token for the next call.
+			b.last = b.last.Add(time.Duration(added) * time.Second / refillPerS)
+		}
+	}
+	b.lastSeen = now
+	if b.tokens < cost {
+		return false
+	}
+	b.tokens -= cost
+	return true
+}
+
+// count returns the total number of live buckets across all shards, for the
+// active_rate_limit_buckets gauge.
+func (rl *rateLimiter) count() int {
+	n := 0
+	for _, sh := range rl.shards {
+		sh.mu.Lock()
+		n += len(sh.m)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// tokenLevels returns a snapshot of every live bucket's current token
+// count, for the token_bucket_level histogram. It's O(active buckets) and
+// is only ever called from the infrequent metrics sample loop.
+func (rl *rateLimiter) tokenLevels() []int {
+	levels := make([]int, 0, 1024)
+	for _, sh := range rl.shards {
+		sh.mu.Lock()
+		for _, b := range sh.m {
+			levels = append(levels, b.tokens)
+		}
+		sh.mu.Unlock()
+	}
+	return levels
+}
+
+// sweepLoop runs on its own goroutine (started once from main) and evicts
+// idle buckets shard by shard, so it only ever holds one shard's lock at a
+// time rather than blocking the whole table.
+func (rl *rateLimiter) sweepLoop() {
+	t := time.NewTicker(sweepEvery)
+	defer t.Stop()
+	for now := range t.C {
+		for _, sh := range rl.shards {
+			sh.mu.Lock()
+			for addr, b := range sh.m {
+				if now.Sub(b.lastSeen) > bucketTTL {
+					delete(sh.m, addr)
+				}
+			}
+			sh.mu.Unlock()
+		}
+	}
+}
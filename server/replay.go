@@ -0,0 +1,43 @@
+package main
+
+// replayWindow is a 64-bit sliding anti-replay window, the same scheme used
+// by IPsec and most UDP-based VPN protocols (e.g. govpn): we remember the
+// highest sequence number seen so far plus a 64-bit bitmap covering it
+// (bit 0) and the 63 sequence numbers below it. A packet is accepted once
+// and only once.
+type replayWindow struct {
+	highest uint64
+	bitmap  uint64
+}
+
+const replayWindowSize = 64
+
+// accept reports whether seq is new with respect to the window and, if so,
+// marks it seen. It returns false for duplicates and for packets too old to
+// fit in the window.
+func (w *replayWindow) accept(seq uint64) bool {
+	switch {
+	case seq > w.highest:
+		shift := seq - w.highest
+		if shift >= replayWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.highest = seq
+		return true
+
+	case w.highest-seq >= replayWindowSize:
+		// Too far behind the window to ever have been recorded.
+		return false
+
+	default:
+		bit := uint64(1) << (w.highest - seq)
+		if w.bitmap&bit != 0 {
+			return false // already seen
+		}
+		w.bitmap |= bit
+		return true
+	}
+}
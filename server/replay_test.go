@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestReplayWindow_AcceptsInOrder(t *testing.T) {
+	var w replayWindow
+	for seq := uint64(0); seq < 10; seq++ {
+		if !w.accept(seq) {
+			t.Fatalf("accept(%d): want true, got false", seq)
+		}
+	}
+}
+
+func TestReplayWindow_RejectsDuplicate(t *testing.T) {
+	var w replayWindow
+	if !w.accept(5) {
+		t.Fatal("accept(5): want true on first delivery")
+	}
+	if w.accept(5) {
+		t.Fatal("accept(5): want false on replay")
+	}
+}
+
+func TestReplayWindow_AcceptsOutOfOrderWithinWindow(t *testing.T) {
+	var w replayWindow
+	if !w.accept(10) {
+		t.Fatal("accept(10): want true")
+	}
+	if !w.accept(8) {
+		t.Fatal("accept(8): want true (within window, not yet seen)")
+	}
+	if w.accept(8) {
+		t.Fatal("accept(8): want false on replay of an out-of-order packet")
+	}
+	if !w.accept(9) {
+		t.Fatal("accept(9): want true (still within window, not yet seen)")
+	}
+}
+
+func TestReplayWindow_RejectsTooFarBehind(t *testing.T) {
+	var w replayWindow
+	if !w.accept(replayWindowSize) {
+		t.Fatalf("accept(%d): want true", replayWindowSize)
+	}
+	if w.accept(0) {
+		t.Fatal("accept(0): want false, exactly replayWindowSize behind highest")
+	}
+}
+
+func TestReplayWindow_SlideDropsOldBits(t *testing.T) {
+	var w replayWindow
+	if !w.accept(0) {
+		t.Fatal("accept(0): want true")
+	}
+	// Slide the window forward by exactly one window's width: seq 0 falls
+	// out the back and a later replay of it must be rejected, not
+	// accidentally accepted because its bit got shifted out of the bitmap.
+	if !w.accept(replayWindowSize) {
+		t.Fatalf("accept(%d): want true", replayWindowSize)
+	}
+	if w.accept(0) {
+		t.Fatal("accept(0) after sliding past it: want false")
+	}
+}
+
+func TestReplayWindow_LargeForwardJumpResetsBitmap(t *testing.T) {
+	var w replayWindow
+	if !w.accept(1) {
+		t.Fatal("accept(1): want true")
+	}
+	// A jump bigger than the window should reset the bitmap rather than
+	// shifting undefined bits in (Go shifts by >= bit width are defined as
+	// zero, but the logic has its own explicit branch for this).
+	farSeq := uint64(1) + replayWindowSize + 100
+	if !w.accept(farSeq) {
+		t.Fatalf("accept(%d): want true", farSeq)
+	}
+	// farSeq-1 is within the window of the new highest and wasn't seen
+	// before the jump, so it must be accepted — not rejected because of
+	// stale bits the reset failed to clear.
+	if !w.accept(farSeq - 1) {
+		t.Fatalf("accept(%d): want true, newly within the reset window", farSeq-1)
+	}
+	if w.accept(farSeq - 1) {
+		t.Fatalf("accept(%d): want false on replay", farSeq-1)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	maxTokens  = 60 // burst capacity
+	refillPerS = 30 // tokens per second
+	cost       = 1
+	bucketTTL  = 2 * time.Minute
+	sweepEvery = 30 * time.Second
+)
+
+// bucket is the per-source-address token bucket used for flood control; see
+// rateLimiter in ratelimit.go for how it's sharded and locked.
+type bucket struct {
+	tokens   int
+	last     time.Time
+	lastSeen time.Time
+}
+
+// server holds everything the echo loop needs, whether it's being driven by
+// one goroutine doing plain ReadFromUDP/WriteToUDP or by a pool of workers
+// draining the socket with batched recvmmsg/sendmmsg.
+type server struct {
+	pc         *net.UDPConn
+	cipherKind string
+	secret     []byte // pre-shared handshake authentication key (LATTICE_SECRET)
+	frameLen   int    // wire size of a data frame for cipherKind
+	maxLen     int    // largest of frameLen and clientHandshakeLen, for read buffers
+
+	limiter  *rateLimiter
+	metrics  *metrics
+	sessions *sessionStore
+}
+
+func newServer(pc *net.UDPConn, cipherKind string, secret []byte) (*server, error) {
+	// Build a throwaway cipher just to learn the data frame size for
+	// cipherKind; the real per-session ciphers are created at handshake
+	// time with session-specific keys.
+	probe, err := NewCipher(cipherKind, secret)
+	if err != nil {
+		return nil, err
+	}
+	frameLen := probe.FrameLen()
+	maxLen := frameLen
+	if clientHandshakeLen > maxLen {
+		maxLen = clientHandshakeLen
+	}
+	return &server{
+		pc:         pc,
+		cipherKind: cipherKind,
+		secret:     secret,
+		frameLen:   frameLen,
+		maxLen:     maxLen,
+		limiter:    newRateLimiter(),
+		metrics:    newMetrics(),
+		sessions:   newSessionStore(),
+	}, nil
+}
+
+// process dispatches one received UDP payload and returns the bytes to
+// send back to the sender, or nil to drop it silently.
+func (s *server) process(frame []byte, ip net.IP) []byte {
+	s.metrics.packetsReceived.Inc()
+
+	switch {
+	case len(frame) == clientHandshakeLen && isMagic(frame, handshakeMagic):
+		if !s.allow(ip) {
+			s.metrics.drop(reasonRateLimited)
+			return nil
+		}
+		resp := s.handleHandshake(frame)
+		if resp == nil {
+			s.metrics.drop(reasonBadHandshake)
+			return nil
+		}
+		return resp
+
+	case len(frame) == s.frameLen && isMagic(frame, dataMagic):
+		ok, reason := s.handleData(frame, ip)
+		if !ok {
+			s.metrics.drop(reason)
+			return nil
+		}
+		s.metrics.packetsEchoed.Inc()
+		return frame // echo 1:1 (not an amplifier)
+
+	default:
+		// A frame whose length matches a known frame type but lands here
+		// anyway must have failed the magic check for that type; anything
+		// else is simply the wrong size to be any known frame.
+		if len(frame) == clientHandshakeLen || len(frame) == s.frameLen {
+			s.metrics.drop(reasonBadMagic)
+		} else {
+			s.metrics.drop(reasonBadLength)
+		}
+		return nil
+	}
+}
+
+func isMagic(frame []byte, magic string) bool {
+	return len(frame) >= magicLen && string(frame[:magicLen]) == magic
+}
+
+const dataMagic = "LATO"
+
+// allow applies the per-source-address token bucket, independent of any
+// session.
+func (s *server) allow(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	return s.limiter.allow(addr.Unmap())
+}
+
+// runSingle drives the echo loop with plain ReadFromUDP/WriteToUDP. It is
+// safe to run concurrently from multiple goroutines on the same *net.UDPConn.
+func (s *server) runSingle() {
+	buf := make([]byte, s.maxLen)
+	for {
+		readStart := time.Now()
+		n, addr, err := s.pc.ReadFromUDP(buf)
+		s.metrics.readLatency.Observe(time.Since(readStart).Seconds())
+		if err != nil {
+			continue
+		}
+		resp := s.process(buf[:n], addr.IP)
+		if resp == nil {
+			continue
+		}
+		writeStart := time.Now()
+		_, _ = s.pc.WriteToUDP(resp, addr)
+		s.metrics.writeLatency.Observe(time.Since(writeStart).Seconds())
+	}
+}
+
+func logListening(addr string, batch bool, batchSize, workers int) {
+	if batch {
+		logger.Info("LATTICE UDP echo listening", "addr", addr, "udp", true, "batched", true, "batch_size", batchSize, "workers", workers)
+		return
+	}
+	logger.Info("LATTICE UDP echo listening", "addr", addr, "udp", true, "batched", false, "workers", workers)
+}
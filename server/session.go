@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handshake: data frames are no longer authenticated with the secret that
+// every client shares; that secret now only authenticates the handshake
+// itself. Each client performs an ephemeral X25519 ECDH
+// exchange with the server, authenticated by the pre-shared LATTICE_SECRET
+// acting as the server's static identity (the "IK" half of Noise-IK,
+// without the full Noise framing). The resulting per-peer key is used to
+// open a short-lived session; data frames authenticate with that session
+// key instead of the pre-shared secret, and a short session ID replaces
+// looking clients up by IP.
+const (
+	handshakeMagic = "LATH"
+	ephemeralLen   = 32 // X25519 public key size
+	handshakeTag   = 4
+
+	clientHandshakeLen = magicLen + ephemeralLen + handshakeTag
+	serverHandshakeLen = magicLen + ephemeralLen + sessionIDLen + handshakeTag
+
+	maxSessionBytes = 1 << 30 // force a fresh handshake after 1 GiB on a session key
+	maxSessionAge   = 10 * time.Minute
+)
+
+// session is a live per-peer key established by a handshake. Rekeying is
+// coarse but simple: once a session is expired, its ID is forgotten and the
+// client must perform a fresh handshake to get a new one. bytes is updated
+// from whichever worker goroutine handles each packet, so it's an
+// atomic.Uint64 rather than something guarded by the session store's shard
+// lock (held only for the map lookup itself, not for the packet's
+// duration). For the same reason replay is guarded by its own replayMu.
+type session struct {
+	id       uint64
+	cph      Cipher
+	created  time.Time
+	bytes    atomic.Uint64
+	replayMu sync.Mutex
+	replay   replayWindow
+}
+
+func (s *session) expired(now time.Time) bool {
+	return s.bytes.Load() > maxSessionBytes || now.Sub(s.created) > maxSessionAge
+}
+
+// sessionShard is one stripe of a sessionStore: its own lock and its own
+// slice of the session ID space, so that LATTICE_WORKERS goroutines mostly
+// hit different shards instead of serializing on one lock per packet — the
+// same fix chunk0-5 applied to the rate-limit table.
+type sessionShard struct {
+	mu sync.Mutex
+	m  map[uint64]*session
+}
+
+// sessionStore shards live sessions by their (already random) ID, so no
+// hashing is needed to pick a shard.
+type sessionStore struct {
+	shards [shardCount]*sessionShard
+}
+
+func newSessionStore() *sessionStore {
+	st := &sessionStore{}
+	for i := range st.shards {
+		st.shards[i] = &sessionShard{m: make(map[uint64]*session)}
+	}
+	return st
+}
+
+func (st *sessionStore) shardFor(id uint64) *sessionShard {
+	return st.shards[id&(shardCount-1)]
+}
+
+func (st *sessionStore) put(sess *session) {
+	sh := st.shardFor(sess.id)
+	sh.mu.Lock()
+	sh.m[sess.id] = sess
+	sh.mu.Unlock()
+}
+
+func (st *sessionStore) get(id uint64) (*session, bool) {
+	sh := st.shardFor(id)
+	sh.mu.Lock()
+	sess, ok := sh.m[id]
+	sh.mu.Unlock()
+	return sess, ok
+}
+
+func (st *sessionStore) delete(id uint64) {
+	sh := st.shardFor(id)
+	sh.mu.Lock()
+	delete(sh.m, id)
+	sh.mu.Unlock()
+}
+
+// count returns the total number of live sessions across all shards, for
+// the active_sessions gauge and the /debug/buckets endpoint.
+func (st *sessionStore) count() int {
+	n := 0
+	for _, sh := range st.shards {
+		sh.mu.Lock()
+		n += len(sh.m)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// sweep evicts expired sessions shard by shard, the same way
+// rateLimiter.sweepLoop reaps idle buckets.
+func (st *sessionStore) sweep(now time.Time) {
+	for _, sh := range st.shards {
+		sh.mu.Lock()
+		for id, sess := range sh.m {
+			if sess.expired(now) {
+				delete(sh.m, id)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// sweepSessions runs on its own goroutine (started once from main) and
+// evicts expired sessions. Without it a handshake that's never followed by
+// data traffic — whether an idle client or a handshake-flood attacker —
+// would sit in the session store forever.
+func (s *server) sweepSessions() {
+	t := time.NewTicker(sweepEvery)
+	defer t.Stop()
+	for now := range t.C {
+		s.sessions.sweep(now)
+	}
+}
+
+// handleHandshake verifies a client handshake packet, performs the ECDH
+// exchange, and returns the server's reply (or nil to drop the packet).
+func (s *server) handleHandshake(frame []byte) []byte {
+	tagAt := clientHandshakeLen - handshakeTag
+	want := hmacTag(s.secret, frame[:tagAt])
+	got := binary.BigEndian.Uint32(frame[tagAt:])
+	if want != got {
+		return nil
+	}
+
+	clientPub, err := ecdh.X25519().NewPublicKey(frame[magicLen:tagAt])
+	if err != nil {
+		return nil
+	}
+
+	serverKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+
+	shared, err := serverKey.ECDH(clientPub)
+	if err != nil {
+		return nil
+	}
+
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(clientPub.Bytes())
+	h.Write(serverKey.PublicKey().Bytes())
+	sessionKey := h.Sum(nil)
+
+	cph, err := NewCipher(s.cipherKind, sessionKey)
+	if err != nil {
+		return nil
+	}
+
+	var idBuf [sessionIDLen]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return nil
+	}
+	id := binary.BigEndian.Uint64(idBuf[:])
+
+	sess := &session{id: id, cph: cph, created: time.Now()}
+	s.sessions.put(sess)
+
+	sidOffset := magicLen + ephemeralLen
+	resp := make([]byte, serverHandshakeLen)
+	copy(resp[:magicLen], handshakeMagic)
+	copy(resp[magicLen:sidOffset], serverKey.PublicKey().Bytes())
+	binary.BigEndian.PutUint64(resp[sidOffset:sidOffset+sessionIDLen], id)
+	tag := hmacTag(s.secret, resp[:serverHandshakeLen-handshakeTag])
+	binary.BigEndian.PutUint32(resp[serverHandshakeLen-handshakeTag:], tag)
+	return resp
+}
+
+// handleData authenticates an established-session data frame and reports
+// whether it should be echoed back, plus a drop reason when it shouldn't.
+// Rate limiting stays keyed by source IP (it's a flood control, not an
+// identity check); replay protection moves onto the session, which is a
+// firmer notion of "peer" than an IP ever was.
+func (s *server) handleData(frame []byte, ip net.IP) (bool, string) {
+	sid := binary.BigEndian.Uint64(frame[magicLen : magicLen+sessionIDLen])
+
+	sess, ok := s.sessions.get(sid)
+	if !ok {
+		return false, reasonUnknownSess
+	}
+	if sess.expired(time.Now()) {
+		s.sessions.delete(sid)
+		return false, reasonUnknownSess
+	}
+
+	if !s.allow(ip) {
+		return false, reasonRateLimited
+	}
+
+	seq, ok := sess.cph.Open(frame)
+	if !ok {
+		return false, reasonBadAuth
+	}
+	sess.replayMu.Lock()
+	fresh := sess.replay.accept(seq)
+	sess.replayMu.Unlock()
+	if !fresh {
+		return false, reasonReplay
+	}
+
+	// Only count bytes once the frame has actually authenticated under
+	// this session's key; the session ID on the wire is cleartext, so
+	// counting unauthenticated frames would let anyone who's seen one
+	// packet from a victim session force maxSessionBytes and kill it
+	// with zero key material.
+	sess.bytes.Add(uint64(len(frame)))
+	return true, ""
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+// newTestServer builds a server by hand rather than via newServer, so that
+// running many handshake/session tests in one binary doesn't trip
+// newMetrics' prometheus.MustRegister on the shared default registry.
+// Neither handleHandshake nor handleData touches s.metrics.
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	cph, err := NewCipher("hmac", testSecret)
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	return &server{
+		cipherKind: "hmac",
+		secret:     testSecret,
+		frameLen:   cph.FrameLen(),
+		limiter:    newRateLimiter(),
+		sessions:   newSessionStore(),
+	}
+}
+
+// buildHandshakeFrame assembles a valid client handshake packet the way a
+// real client would: an ephemeral X25519 public key HMAC-tagged with the
+// pre-shared secret. It returns the frame plus the private key, so the
+// caller can finish the ECDH exchange on its own side.
+func buildHandshakeFrame(t *testing.T, secret []byte) ([]byte, *ecdh.PrivateKey) {
+	t.Helper()
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	frame := make([]byte, clientHandshakeLen)
+	copy(frame[:magicLen], handshakeMagic)
+	copy(frame[magicLen:magicLen+ephemeralLen], priv.PublicKey().Bytes())
+	tagAt := clientHandshakeLen - handshakeTag
+	binary.BigEndian.PutUint32(frame[tagAt:], hmacTag(secret, frame[:tagAt]))
+	return frame, priv
+}
+
+func TestHandleHandshake_EstablishesSession(t *testing.T) {
+	s := newTestServer(t)
+	frame, clientPriv := buildHandshakeFrame(t, testSecret)
+
+	resp := s.handleHandshake(frame)
+	if resp == nil {
+		t.Fatal("handleHandshake: want a response for a valid handshake")
+	}
+	if len(resp) != serverHandshakeLen {
+		t.Fatalf("handleHandshake: response is %d bytes, want %d", len(resp), serverHandshakeLen)
+	}
+
+	tagAt := serverHandshakeLen - handshakeTag
+	want := hmacTag(s.secret, resp[:tagAt])
+	got := binary.BigEndian.Uint32(resp[tagAt:])
+	if want != got {
+		t.Fatal("handleHandshake: response tag does not verify under the pre-shared secret")
+	}
+
+	sidOffset := magicLen + ephemeralLen
+	id := binary.BigEndian.Uint64(resp[sidOffset : sidOffset+sessionIDLen])
+	if _, ok := s.sessions.get(id); !ok {
+		t.Fatal("handleHandshake: session ID in the response was not stored in s.sessions")
+	}
+
+	serverPub, err := ecdh.X25519().NewPublicKey(resp[magicLen:sidOffset])
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v", err)
+	}
+	if _, err := clientPriv.ECDH(serverPub); err != nil {
+		t.Fatalf("client-side ECDH against the server's ephemeral key failed: %v", err)
+	}
+}
+
+func TestHandleHandshake_RejectsBadTag(t *testing.T) {
+	s := newTestServer(t)
+	frame, _ := buildHandshakeFrame(t, testSecret)
+	frame[len(frame)-1] ^= 0xFF
+
+	if resp := s.handleHandshake(frame); resp != nil {
+		t.Fatal("handleHandshake: want nil for a frame with a bad HMAC tag")
+	}
+}
+
+func TestHandleHandshake_RejectsWrongSecret(t *testing.T) {
+	s := newTestServer(t)
+	frame, _ := buildHandshakeFrame(t, []byte("a-completely-different-secret!!"))
+
+	if resp := s.handleHandshake(frame); resp != nil {
+		t.Fatal("handleHandshake: want nil when the client used a different pre-shared secret")
+	}
+}
+
+func TestHandleHandshake_RejectsLowOrderPublicKey(t *testing.T) {
+	s := newTestServer(t)
+	frame := make([]byte, clientHandshakeLen)
+	copy(frame[:magicLen], handshakeMagic)
+	// The all-zero point is a well-known low-order X25519 public key;
+	// crypto/ecdh rejects it rather than producing a shared secret.
+	tagAt := clientHandshakeLen - handshakeTag
+	binary.BigEndian.PutUint32(frame[tagAt:], hmacTag(s.secret, frame[:tagAt]))
+
+	if resp := s.handleHandshake(frame); resp != nil {
+		t.Fatal("handleHandshake: want nil for a low-order client public key")
+	}
+}
+
+func TestHandleData_RejectsUnknownSession(t *testing.T) {
+	s := newTestServer(t)
+	frame := make([]byte, s.frameLen)
+	copy(frame[:magicLen], dataMagic)
+	binary.BigEndian.PutUint64(frame[magicLen:magicLen+sessionIDLen], 12345)
+
+	ok, reason := s.handleData(frame, nil)
+	if ok || reason != reasonUnknownSess {
+		t.Fatalf("handleData: got (%v, %q), want (false, %q)", ok, reason, reasonUnknownSess)
+	}
+}